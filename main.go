@@ -2,18 +2,36 @@ package main
 
 import (
 	"os"
+	"os/exec"
+	"path/filepath"
+	"bufio"
 	"io"
 	"io/ioutil"
 	"fmt"
 	"bytes"
 	"net/url"
 	"net/http"
+	"crypto/tls"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 	"context"
 	"mime/multipart"
 	"encoding/json"
 	"math/rand"
 	"time"
+	"sync"
+	"runtime"
+	"runtime/debug"
+	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/ahmdrz/goinsta"
 	"github.com/ahmdrz/goinsta/response"
@@ -27,17 +45,27 @@ func main() {
 	startTelegramBotServer()
 }
 
-func getFileAndUpload(uri string, bot * tgbotapi.BotAPI, update tgbotapi.Update) response.UploadPhotoResponse {
+// getFileAndUpload returns false when the photo was skipped, the chat is told why
+func getFileAndUpload(uri string, bot * tgbotapi.BotAPI, update tgbotapi.Update) (response.UploadPhotoResponse, bool) {
 	insta := loginInstagram()
+	defer insta.Logout()
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "ℹ️ logged in to Instagram"))
 
 	resp := getPhoto(uri)
+	defer resp.Body.Close()
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ got photo from uri: %s", uri)))
 
 	// TODO parse and use geotags from photo
 
-	photoCaption := getCaption(resp)
-	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ raw photo caption: %s", photoCaption)))
+	photoCaption, captionJobId := getCaption(resp)
+	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ raw photo caption: %s (job id: %s)", photoCaption, captionJobId)))
+
+	photoCaption, err := limitCaption(photoCaption)
+
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("⚠️ skipped the photo: %s", err)))
+		return response.UploadPhotoResponse{}, false
+	}
 
 	captionEmoji := getEmoji(photoCaption)
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ got some emojis from caption: %s", captionEmoji)))
@@ -52,21 +80,19 @@ func getFileAndUpload(uri string, bot * tgbotapi.BotAPI, update tgbotapi.Update)
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ picked up filter: %s", filter)))
 
 	styledPhoto := stylize(resp, filter)
+	defer styledPhoto.Body.Close()
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ applied style transfer")))
 
+	waitForUploadSlot()
 	uploadPhotoResponse := upload(insta, styledPhoto.Body, finalCaption)
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ uploaded to Instagram")))
 
 	disableComments(insta, uploadPhotoResponse)
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ disabled comments")))
 
-	defer styledPhoto.Body.Close()
-	defer resp.Body.Close()
-	defer insta.Logout()
-
 	bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("ℹ️ logged out from Instagram")))
 
-	return uploadPhotoResponse
+	return uploadPhotoResponse, true
 }
 
 func getEmoji(text string) string {
@@ -77,10 +103,17 @@ func getEmoji(text string) string {
 	}
 
 	reqUrl := emojiApiUrl + "?text=" + url.QueryEscape(text)
-	res, err := http.Get(reqUrl)
+	client := &http.Client{Timeout: getEnvTimeout("EMOJI_API_TIMEOUT")}
+	res, err := client.Get(reqUrl)
 
-	if err != nil || res.StatusCode != 200 {
-		panic(fmt.Sprintf("Error while doing a request: %s, %s", err, res))
+	if err != nil {
+		panic(fmt.Sprintf("Error while doing a request: %s", err))
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		panic(fmt.Sprintf("Emoji API responded with %s", res.Status))
 	}
 
 	emojis, err := ioutil.ReadAll(res.Body)
@@ -88,21 +121,99 @@ func getEmoji(text string) string {
 		panic(fmt.Sprintf("Couldn't read response: %s", err))
 	}
 
+	audit("emoji received from %s: %d bytes", res.Request.URL.Host, len(emojis))
+
 	return string(emojis)
 }
 
 func mergeCaptions(caption string, emoji string, hashtags string) string {
-	return caption + emoji + "\n.\n.\n.\n" + hashtags
+	// Instagram won't take captions longer than 2200 characters
+	maxLength := getEnvInt("MAX_CAPTION_LENGTH", 2200)
+
+	return truncateCaption(filterCaption(caption + emoji + "\n.\n.\n.\n" + hashtags), maxLength)
+}
+
+// filterCaption pipes the caption through CAPTION_FILTER_COMMAND and takes its output as the caption,
+// running commands from the environment has to be explicitly allowed with ALLOW_CAPTION_FILTER_COMMAND
+func filterCaption(caption string) string {
+	command := strings.Fields(os.Getenv("CAPTION_FILTER_COMMAND"))
+
+	if len(command) == 0 {
+		return caption
+	}
+
+	if len(os.Getenv("ALLOW_CAPTION_FILTER_COMMAND")) == 0 {
+		panic("Refusing to run the caption filter command, set ALLOW_CAPTION_FILTER_COMMAND to allow it")
+	}
+
+	ctx := context.Background()
+
+	if timeout := time.Duration(getEnvNonNegativeInt("CAPTION_FILTER_TIMEOUT", 10)) * time.Second; timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = strings.NewReader(caption)
+	cmd.Stderr = &stderr
+
+	filtered, err := cmd.Output()
+
+	if err != nil {
+		panic(fmt.Sprintf("Caption filter command '%s' failed: %s %s", strings.Join(command, " "), err, stderr.String()))
+	}
+
+	return strings.TrimRight(string(filtered), "\r\n")
+}
+
+// truncateCaption cuts the caption down to maxLength characters on a word boundary,
+// ending it with an ellipsis if CAPTION_ELLIPSIS is set
+func truncateCaption(caption string, maxLength int) string {
+	runes := []rune(caption)
+
+	if len(runes) <= maxLength {
+		return caption
+	}
+
+	ellipsis := ""
+
+	if len(os.Getenv("CAPTION_ELLIPSIS")) != 0 {
+		ellipsis = "…"
+	}
+
+	cut := maxLength - utf8.RuneCountInString(ellipsis)
+
+	if cut < 0 {
+		cut = 0
+	}
+
+	end := cut
+
+	for end > 0 && !unicode.IsSpace(runes[end]) { // step back so no word is cut in half
+		end--
+	}
+
+	if end == 0 {
+		end = cut // a single word longer than the limit, nothing else to do
+	}
+
+	return strings.TrimRightFunc(string(runes[:end]), unicode.IsSpace) + ellipsis
 }
 
-func getCaption(resp * http.Response) string {
+// getCaption returns the photo caption along with the caption API job id,
+// the latter is handy to find the request on the provider's dashboard
+func getCaption(resp * http.Response) (string, string) {
 	captionApiUrl := os.Getenv("CAPTION_API_URL")
-	captionApiKey := os.Getenv("CAPTION_API_KEY")
+	captionApiKey := getSecret("CAPTION_API_KEY")
 
 	if len(captionApiUrl) * len(captionApiKey) == 0 {
 		panic(fmt.Sprintf("Please provide caption api url '%s' and key '%s'", captionApiUrl, captionApiKey))
 	}
 
+	requireHttps("caption api", captionApiUrl) // the api key is sent along with the photo
+
 	b := bytes.NewBuffer(make([]byte, 0)) // temporary buffer
 	photo := io.TeeReader(resp.Body, b) // returns a reader that writes contents of resp.Body to b
 
@@ -118,6 +229,19 @@ func getCaption(resp * http.Response) string {
 		panic(fmt.Sprintf("Couldn't copy file to form dest %s", err))
 	}
 
+	defer resp.Body.Close() // we're done w/ resp.Body
+	resp.Body = ioutil.NopCloser(b) // returns a ReadCloser w/ no-op Close
+
+	captioned := false
+
+	defer func(photo []byte) {
+		if !captioned {
+			keepFailedPhoto(photo)
+		}
+	}(b.Bytes())
+
+	addExtraFields(w, os.Getenv("CAPTION_API_EXTRA_FIELDS"))
+
 	w.Close() // So the terminating boundary would be there in place
 
 	req, err := http.NewRequest("POST", captionApiUrl, &postData)
@@ -130,29 +254,406 @@ func getCaption(resp * http.Response) string {
 	req.Header.Set("Content-Type", w.FormDataContentType())
 	req.Header.Set("Api-Key", captionApiKey)
 
-	client := &http.Client{}
-	res, err := client.Do(req)
+	audit("caption requested from %s: %d bytes", req.URL.Host, req.ContentLength)
+
+	client := getCaptionClient()
+	res, err := doHedged(client, req, time.Duration(getEnvNonNegativeInt("CAPTION_API_HEDGE_DELAY", 0)) * time.Millisecond)
 	if err != nil {
-		panic(fmt.Sprintf("Error while doing a request %s: %s", req, res))
+		panic(fmt.Sprintf("Error while doing a request to %s: %s", req.URL.Host, err))
 	}
 
-	type CaptionApiResponse struct {
-		Output string
-		Job_id int
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		panic(fmt.Sprintf("Caption API refused the key with status %d, check that CAPTION_API_KEY is valid and not expired", res.StatusCode))
 	}
 
-	var captionResponse CaptionApiResponse
+	var caption, jobId string // streamed captions come without a job id
 
-	err = json.NewDecoder(res.Body).Decode(&captionResponse)
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		caption = readCaptionStream(res)
+	} else {
+		caption, jobId = parseCaptionResponse(res)
+	}
+
+	audit("caption received from %s: status %d, %d characters, job id '%s'", req.URL.Host, res.StatusCode, utf8.RuneCountInString(caption), jobId)
+
+	caption = normalizeCaption(caption)
+	captioned = true
+
+	return caption, jobId
+}
+
+// keepFailedPhoto saves a photo that couldn't be captioned to FAILED_PHOTO_DIR so the failure could be
+// reproduced, photos older than the retention are removed and the directory is kept under its size cap
+func keepFailedPhoto(photo []byte) {
+	dir := os.Getenv("FAILED_PHOTO_DIR")
+
+	if len(dir) == 0 {
+		return
+	}
+
+	retention := time.Duration(getEnvInt("FAILED_PHOTO_RETENTION", 72)) * time.Hour
+	maxDirSize := int64(getEnvInt("FAILED_PHOTO_DIR_MAX_SIZE", 100 * 1024 * 1024))
+
+	kept, err := filepath.Glob(filepath.Join(dir, "failed-*.jpg"))
+
+	if err != nil {
+		log.Printf("Couldn't list failed photos in '%s': %s", dir, err)
+		return
+	}
+
+	dirSize := int64(len(photo))
+
+	for _, name := range kept {
+		info, err := os.Stat(name)
+
+		if err != nil {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > retention {
+			os.Remove(name)
+		} else {
+			dirSize += info.Size()
+		}
+	}
+
+	if dirSize > maxDirSize {
+		log.Printf("Not keeping the failed photo, '%s' would grow over %d bytes", dir, maxDirSize)
+		return
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("failed-%d.jpg", time.Now().UnixNano()))
+
+	if err := ioutil.WriteFile(name, photo, 0600); err != nil {
+		log.Printf("Couldn't keep the failed photo: %s", err)
+		return
+	}
+
+	log.Printf("Kept the photo that couldn't be captioned in '%s'", name)
+}
+
+// parseCaptionResponse takes the caption and job id out of the json caption API response
+func parseCaptionResponse(res * http.Response) (string, string) {
+	var captionResponse interface{}
+
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber() // keep numeric job ids as they are
+	err := decoder.Decode(&captionResponse)
 
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't parse json response %s", err))
 	}
 
-	defer resp.Body.Close() // we're done w/ resp.Body
-	resp.Body = ioutil.NopCloser(b) // returns a ReadCloser w/ no-op Close
+	// providers nest their responses differently, so the fields are looked up by configurable paths
+	if errorPath := os.Getenv("CAPTION_API_ERROR_PATH"); len(errorPath) != 0 {
+		if apiError, found := lookupJsonPath(captionResponse, errorPath); found && apiError != nil {
+			panic(fmt.Sprintf("Caption API returned an error: %v", apiError))
+		}
+	}
+
+	outputPath := getEnv("CAPTION_API_OUTPUT_PATH", "output")
+	output, found := lookupJsonPath(captionResponse, outputPath)
+	caption, isString := output.(string)
+
+	if !found || !isString {
+		panic(fmt.Sprintf("Couldn't find a caption at '%s' in caption API response", outputPath))
+	}
+
+	jobId := ""
+
+	if id, found := lookupJsonPath(captionResponse, getEnv("CAPTION_API_JOB_ID_PATH", "job_id")); found && id != nil {
+		jobId = fmt.Sprint(id)
+	}
+
+	return caption, jobId
+}
+
+// addExtraFields writes static form fields some providers need besides the photo,
+// the fields are given url query style, e.g. "model=large&lang=en"
+func addExtraFields(w * multipart.Writer, fields string) {
+	values, err := url.ParseQuery(fields)
+
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't parse extra form fields '%s': %s", fields, err))
+	}
+
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range values[name] {
+			if err := w.WriteField(name, value); err != nil {
+				panic(fmt.Sprintf("Couldn't write extra field '%s' on form data: %s", name, err))
+			}
+		}
+	}
+}
+
+// readCaptionStream assembles the caption from tokens streamed as Server-Sent Events, each event's
+// data is either a raw token or json with the token at CAPTION_API_STREAM_TOKEN_PATH
+func readCaptionStream(res * http.Response) string {
+	timeout := time.Duration(getEnvNonNegativeInt("CAPTION_API_STREAM_TIMEOUT", 60)) * time.Second
+	var timer * time.Timer
+
+	if timeout != 0 {
+		timer = time.AfterFunc(timeout, func() { res.Body.Close() }) // unblocks the reading below
+	}
+
+	tokenPath := os.Getenv("CAPTION_API_STREAM_TOKEN_PATH")
+	caption := ""
+	scanner := bufio.NewScanner(res.Body)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if !strings.HasPrefix(line, "data:") {
+			continue // event names, ids, comments and blank lines between events
+		}
+
+		data := strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+
+		if data == "[DONE]" {
+			break
+		}
+
+		if len(tokenPath) == 0 {
+			caption += data
+			continue
+		}
+
+		var event interface{}
+
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			panic(fmt.Sprintf("Couldn't parse caption stream event '%s': %s", data, err))
+		}
+
+		if token, found := lookupJsonPath(event, tokenPath); found {
+			if text, isString := token.(string); isString {
+				caption += text
+			}
+		}
+	}
+
+	if timer != nil && !timer.Stop() {
+		panic(fmt.Sprintf("Caption API stream timed out after %s", timeout))
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(fmt.Sprintf("Couldn't read caption stream: %s", err))
+	}
+
+	return caption
+}
+
+// lookupJsonPath walks a decoded json value by a dot separated path such as "data.captions.0.text",
+// object keys are matched case-insensitively just like encoding/json does for struct fields
+func lookupJsonPath(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		found := false
+
+		switch node := value.(type) {
+		case map[string]interface{}:
+			if value, found = node[key]; !found {
+				for k, v := range node {
+					if strings.EqualFold(k, key) {
+						value, found = v, true
+						break
+					}
+				}
+			}
+		case []interface{}:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node) {
+				value, found = node[i], true
+			}
+		}
+
+		if !found {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+var (
+	captionClient * http.Client
+	captionClientOnce sync.Once
+)
+
+// getCaptionClient returns the client shared by all caption requests so the connections
+// to the caption API are kept alive and reused, HTTP/2 is used when the server supports it
+func getCaptionClient() * http.Client {
+	captionClientOnce.Do(func() {
+		transport := http.DefaultTransport.(* http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = getEnvInt("CAPTION_API_MAX_IDLE_CONNS", http.DefaultMaxIdleConnsPerHost)
+		transport.IdleConnTimeout = time.Duration(getEnvInt("CAPTION_API_IDLE_TIMEOUT", 90)) * time.Second
+
+		if fingerprint := os.Getenv("CAPTION_API_CERT_FINGERPRINT"); len(fingerprint) != 0 {
+			transport.TLSClientConfig = &tls.Config{VerifyPeerCertificate: pinCertificate(fingerprint)}
+		}
+
+		captionClient = &http.Client{Transport: transport, Timeout: getEnvTimeout("CAPTION_API_TIMEOUT")}
+	})
+
+	return captionClient
+}
+
+// pinCertificate only lets through the server certificate with the given hex sha256 fingerprint,
+// this is checked on top of the usual certificate chain verification
+func pinCertificate(fingerprint string) func([][]byte, [][]* x509.Certificate) error {
+	expected, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+
+	if err != nil || len(expected) != sha256.Size {
+		panic(fmt.Sprintf("Please provide a valid sha256 certificate fingerprint, got '%s'", fingerprint))
+	}
+
+	return func(rawCerts [][]byte, _ [][]* x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no server certificate to check the pinned fingerprint against")
+		}
+
+		actual := sha256.Sum256(rawCerts[0])
+
+		if !bytes.Equal(actual[:], expected) {
+			return fmt.Errorf("server certificate fingerprint %x doesn't match the pinned one", actual)
+		}
+
+		return nil
+	}
+}
+
+// doHedged sends the request and, if there's no response after the delay, sends it once more,
+// whichever succeeds first is returned and the other one is cancelled. Zero delay disables hedging,
+// as it could double the number of paid API calls
+func doHedged(client * http.Client, req * http.Request, delay time.Duration) (* http.Response, error) {
+	if delay == 0 || req.GetBody == nil {
+		return client.Do(req)
+	}
+
+	type attempt struct {
+		i int
+		res * http.Response
+		err error
+	}
+
+	attempts := make(chan attempt, 2)
+	var cancels []context.CancelFunc
+
+	send := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		i := len(cancels) - 1
+
+		r := req.Clone(ctx)
+		r.Body, _ = req.GetBody() // every attempt needs a fresh copy of the body
+
+		if i > 0 { // the first one is audited by the caller
+			audit("caption requested again from %s: attempt %d after %s", r.URL.Host, i + 1, delay)
+		}
+
+		go func() {
+			res, err := client.Do(r)
+			attempts <- attempt{i, res, err}
+		}()
+	}
+
+	send()
+	hedge := time.NewTimer(delay)
+	defer hedge.Stop()
+
+	pending := 1
+	var won attempt
+
+wait:
+	for pending > 0 {
+		select {
+		case <-hedge.C: // no response in time, try once more
+			send()
+			pending++
+		case won = <-attempts:
+			pending--
+
+			if won.err == nil {
+				break wait
+			}
+		}
+	}
+
+	for i, cancel := range cancels {
+		if i != won.i || won.err != nil {
+			cancel()
+		}
+	}
+
+	go func(pending int) { // responses could still come out of the cancelled ones
+		for ; pending > 0; pending-- {
+			if lost := <-attempts; lost.err == nil {
+				lost.res.Body.Close()
+			}
+		}
+	}(pending)
+
+	if won.err != nil {
+		return nil, won.err
+	}
+
+	won.res.Body = cancelOnClose{won.res.Body, cancels[won.i]}
+
+	return won.res, nil
+}
+
+// cancelOnClose releases the request context once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// limitCaption deals with verbose api captions longer than CAPTION_API_MAX_LENGTH
+// as CAPTION_API_OVERSIZE says: "truncate" them (the default) or "reject" the photo with an error
+func limitCaption(caption string) (string, error) {
+	maxLength := getEnvNonNegativeInt("CAPTION_API_MAX_LENGTH", 0)
+
+	if maxLength == 0 || utf8.RuneCountInString(caption) <= maxLength {
+		return caption, nil
+	}
 
-	return captionResponse.Output
+	switch policy := getEnv("CAPTION_API_OVERSIZE", "truncate"); policy {
+	case "truncate":
+		return truncateCaption(caption, maxLength), nil
+	case "reject":
+		return "", fmt.Errorf("the caption is longer than %d characters", maxLength)
+	default:
+		panic(fmt.Sprintf("Please provide a valid oversized caption handling 'truncate' or 'reject', got '%s'", policy))
+	}
+}
+
+// normalizeCaption trims and collapses whitespace in the raw api caption,
+// optionally drops the trailing period and capitalizes the first letter
+func normalizeCaption(caption string) string {
+	caption = strings.Join(strings.Fields(caption), " ")
+
+	if len(os.Getenv("CAPTION_STRIP_PERIOD")) != 0 {
+		caption = strings.TrimRight(strings.TrimSuffix(caption, "."), " ") // "on grass ." shouldn't keep the space
+	}
+
+	if len(os.Getenv("CAPTION_SENTENCE_CASE")) != 0 && len(caption) != 0 {
+		first, size := utf8.DecodeRuneInString(caption)
+		caption = string(unicode.ToUpper(first)) + caption[size:]
+	}
+
+	return caption
 }
 
 func randomFilter() string {
@@ -194,11 +695,11 @@ func stylize(resp * http.Response, filter string) * http.Response {
 		}
 
 		if fw, err = w.CreateFormField("filter"); err != nil {
-			panic(fmt.Sprintf("Couldn't create a filter field on form data", err))
+			panic(fmt.Sprintf("Couldn't create a filter field on form data: %s", err))
 		}
 
 		if _, err = fw.Write([]byte(filter)); err != nil {
-			panic(fmt.Sprintf("Couldn't write filter to field on form data", err))
+			panic(fmt.Sprintf("Couldn't write filter to field on form data: %s", err))
 		}
 
 		w.Close() // So the terminating boundary would be there in place
@@ -211,17 +712,37 @@ func stylize(resp * http.Response, filter string) * http.Response {
 		// setting correct headers to calculate the post body boundary
 		req.Header.Set("Content-Type", w.FormDataContentType())
 
-		client := &http.Client{}
+		audit("style transfer requested from %s: %d bytes, filter %s", req.URL.Host, req.ContentLength, filter)
+
+		timeout := getEnvTimeout("STYLE_SERVER_TIMEOUT")
+		client := &http.Client{Timeout: timeout}
 		res, err := client.Do(req)
 		if err != nil {
-			panic(fmt.Sprintf("Error while doing a request %s: %s", req, res))
+			panic(fmt.Sprintf("Error while doing a request to %s: %s", req.URL.Host, err))
 		}
 
+		size := res.ContentLength // -1 when not known up front
+
+		if timeout != 0 {
+			// the timeout covers reading the body, so don't leave that for the slow Instagram upload
+			styledPhoto, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if err != nil {
+				panic(fmt.Sprintf("Couldn't read the styled photo: %s", err))
+			}
+
+			res.Body = ioutil.NopCloser(bytes.NewReader(styledPhoto))
+			size = int64(len(styledPhoto))
+		}
+
+		audit("styled photo received from %s: status %d, %d bytes", req.URL.Host, res.StatusCode, size)
+
 		return res
 }
 
 func startTelegramBotServer() * tgbotapi.BotAPI {
-	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
+	botToken := getSecret("TELEGRAM_BOT_TOKEN")
 	botDebug := os.Getenv("DEBUG_TELEGRAM_BOT")
 
 	if len(botToken) == 0 {
@@ -236,6 +757,8 @@ func startTelegramBotServer() * tgbotapi.BotAPI {
 
 	bot.Debug = bool(len(botDebug) != 0)
 
+	watchPauseSignal()
+
 	webhookEnabled := os.Getenv("WEBHOOK_MODE")
 
 	if len(webhookEnabled) != 0 {
@@ -254,12 +777,10 @@ func longPollUpdates(bot * tgbotapi.BotAPI) {
 	updates, err := bot.GetUpdatesChan(u)
 
 	if err != nil {
-		panic(fmt.Sprintf("Couldn't get updates from chan %s: %s", u, err))
+		panic(fmt.Sprintf("Couldn't get updates from chan %v: %s", u, err))
 	}
 
-	for update := range updates {
-		handleUpdate(bot, update)
-	}
+	handleUpdates(bot, updates)
 }
 
 func setWebhook(bot * tgbotapi.BotAPI) {
@@ -285,16 +806,229 @@ func setWebhook(bot * tgbotapi.BotAPI) {
 		panic("Please provide valid keyfile")
 	}
 
+	if len(os.Getenv("DEBUG_CONFIG_TOKEN")) != 0 {
+		http.HandleFunc("/debug/config", serveConfig)
+	}
+
 	go http.ListenAndServeTLS("0.0.0.0:8433", certfile, keyfile, nil)
 
+	handleUpdates(bot, updates)
+}
+
+// configNames are all the settings the bot takes from the environment
+var configNames = []string{
+	"TELEGRAM_BOT_TOKEN", "TELEGRAM_BOT_TOKEN_FILE", "DEBUG_TELEGRAM_BOT", "MAX_UPLOADS_PER_MINUTE", "MAX_MEMORY_MB",
+	"WEBHOOK_MODE", "SERVER_BASE_URL", "CERT_FILE", "KEY_FILE", "DEBUG_CONFIG_TOKEN",
+	"INSTAGRAM_USERNAME", "INSTAGRAM_PASSWORD", "INSTAGRAM_PASSWORD_FILE",
+	"GOOGLE_APPLICATION_CREDENTIALS", "VISION_API_TIMEOUT",
+	"STYLE_SERVER_URL", "STYLE_SERVER_TIMEOUT",
+	"CAPTION_API_URL", "CAPTION_API_KEY", "CAPTION_API_KEY_FILE", "CAPTION_API_TIMEOUT",
+	"CAPTION_API_EXTRA_FIELDS", "CAPTION_API_OUTPUT_PATH", "CAPTION_API_JOB_ID_PATH", "CAPTION_API_ERROR_PATH",
+	"CAPTION_API_STREAM_TOKEN_PATH", "CAPTION_API_STREAM_TIMEOUT", "CAPTION_API_CERT_FINGERPRINT",
+	"CAPTION_API_MAX_IDLE_CONNS", "CAPTION_API_IDLE_TIMEOUT", "CAPTION_API_HEDGE_DELAY",
+	"CAPTION_API_MAX_LENGTH", "CAPTION_API_OVERSIZE", "CAPTION_SENTENCE_CASE", "CAPTION_STRIP_PERIOD",
+	"FAILED_PHOTO_DIR", "FAILED_PHOTO_RETENTION", "FAILED_PHOTO_DIR_MAX_SIZE",
+	"EMOJI_API_URL", "EMOJI_API_TIMEOUT",
+	"MAX_PHOTO_SIZE", "MIN_PHOTO_WIDTH", "MIN_PHOTO_HEIGHT", "PHOTO_FETCH_RETRIES", "PHOTO_FETCH_BACKOFF", "PHOTO_FETCH_TIMEOUT", "PHOTO_FETCH_BUDGET",
+	"MAX_CAPTION_LENGTH", "CAPTION_ELLIPSIS", "CAPTION_FILTER_COMMAND", "ALLOW_CAPTION_FILTER_COMMAND", "CAPTION_FILTER_TIMEOUT",
+	"AUDIT_LOG_FILE", "ALLOW_INSECURE",
+}
+
+// secretConfigNames are never shown as they are
+var secretConfigNames = map[string]bool{
+	"TELEGRAM_BOT_TOKEN": true,
+	"INSTAGRAM_PASSWORD": true,
+	"CAPTION_API_KEY": true,
+	"DEBUG_CONFIG_TOKEN": true,
+}
+
+// configDefaults are the values in force when a setting isn't in the environment, in its own units,
+// they have to be kept in line with the defaults where the settings are read
+var configDefaults = map[string]string{
+	"MAX_UPLOADS_PER_MINUTE": "0",
+	"MAX_MEMORY_MB": "0",
+	"VISION_API_TIMEOUT": "0",
+	"STYLE_SERVER_TIMEOUT": "0",
+	"CAPTION_API_TIMEOUT": "0",
+	"CAPTION_API_OUTPUT_PATH": "output",
+	"CAPTION_API_JOB_ID_PATH": "job_id",
+	"CAPTION_API_STREAM_TIMEOUT": "60",
+	"CAPTION_API_MAX_IDLE_CONNS": strconv.Itoa(http.DefaultMaxIdleConnsPerHost),
+	"CAPTION_API_IDLE_TIMEOUT": "90",
+	"CAPTION_API_HEDGE_DELAY": "0",
+	"CAPTION_API_MAX_LENGTH": "0",
+	"CAPTION_API_OVERSIZE": "truncate",
+	"FAILED_PHOTO_RETENTION": "72",
+	"FAILED_PHOTO_DIR_MAX_SIZE": strconv.Itoa(100 * 1024 * 1024),
+	"EMOJI_API_TIMEOUT": "0",
+	"MAX_PHOTO_SIZE": strconv.Itoa(20 * 1024 * 1024),
+	"MIN_PHOTO_WIDTH": "0",
+	"MIN_PHOTO_HEIGHT": "0",
+	"PHOTO_FETCH_RETRIES": "2",
+	"PHOTO_FETCH_BACKOFF": "500",
+	"PHOTO_FETCH_TIMEOUT": "0",
+	"PHOTO_FETCH_BUDGET": "0",
+	"MAX_CAPTION_LENGTH": "2200",
+	"CAPTION_FILTER_TIMEOUT": "10",
+}
+
+// serveConfig shows the settings in force, the environment over the defaults, with the secrets
+// redacted. It's guarded by DEBUG_CONFIG_TOKEN as a bearer token
+func serveConfig(w http.ResponseWriter, r * http.Request) {
+	token := os.Getenv("DEBUG_CONFIG_TOKEN")
+	given := r.Header.Get("Authorization") // a bare token without the scheme is refused as well
+
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(given), []byte("Bearer " + token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	config := make(map[string]string)
+
+	for _, name := range configNames {
+		value := getEnv(name, configDefaults[name])
+
+		if secretConfigNames[name] && len(value) != 0 {
+			value = "<redacted>"
+		} else if name == "CAPTION_API_EXTRA_FIELDS" && len(value) != 0 {
+			value = redactFieldValues(value) // the field names help debugging, the values could be credentials
+		}
+
+		config[name] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func redactFieldValues(fields string) string {
+	values, err := url.ParseQuery(fields)
+
+	if err != nil {
+		return "<redacted>"
+	}
+
+	var redacted []string
+
+	for name, list := range values {
+		for range list {
+			redacted = append(redacted, url.QueryEscape(name) + "=<redacted>")
+		}
+	}
+
+	sort.Strings(redacted)
+	return strings.Join(redacted, "&")
+}
+
+func handleUpdates(bot * tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel) {
 	for update := range updates {
+		waitWhilePaused()
+		waitForMemory()
 		handleUpdate(bot, update)
 	}
 }
 
+var lastUpload time.Time // updates are handled one by one, so no locking
+
+// waitForUploadSlot spaces uploads out to at most MAX_UPLOADS_PER_MINUTE,
+// Instagram doesn't like too many of them in a row
+func waitForUploadSlot() {
+	rate := getEnvNonNegativeInt("MAX_UPLOADS_PER_MINUTE", 0)
+
+	if rate == 0 {
+		return
+	}
+
+	if wait := time.Until(lastUpload.Add(time.Minute / time.Duration(rate))); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	lastUpload = time.Now()
+}
+
+var (
+	paused bool
+	pauseMutex sync.Mutex
+	pauseToggled = sync.NewCond(&pauseMutex)
+)
+
+// watchPauseSignal pauses or resumes handling of updates on every SIGUSR1,
+// so the bot could be held e.g. during a provider maintenance without stopping it
+func watchPauseSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			pauseMutex.Lock()
+			paused = !paused
+			log.Printf("Handling of updates paused: %t", paused)
+			pauseMutex.Unlock()
+
+			pauseToggled.Broadcast()
+		}
+	}()
+}
+
+var readMemStats = runtime.ReadMemStats // replaced in tests to fake the memory use
+
+// waitForMemory holds handling of updates while the memory the bot holds from the OS
+// is over MAX_MEMORY_MB, so a run of big photos doesn't get it killed for running out of memory
+func waitForMemory() {
+	maxMemory := uint64(getEnvNonNegativeInt("MAX_MEMORY_MB", 0)) * 1024 * 1024
+
+	if maxMemory == 0 {
+		return
+	}
+
+	for held := false; ; held = true {
+		debug.FreeOSMemory() // garbage from the last photo shouldn't count as used
+		var stats runtime.MemStats
+		readMemStats(&stats)
+		used := stats.Sys - stats.HeapReleased // roughly the resident memory
+
+		if used <= maxMemory {
+			if held {
+				log.Printf("Memory back to %d MB, handling updates again", used / 1024 / 1024)
+			}
+
+			return
+		}
+
+		if !held {
+			log.Printf("Memory at %d MB is over the limit, holding updates", used / 1024 / 1024)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func waitWhilePaused() {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	for paused {
+		pauseToggled.Wait()
+	}
+}
+
 func handleUpdate(bot * tgbotapi.BotAPI, update tgbotapi.Update) {
+	if update.Message == nil {
+		return // not a new message, e.g. an edited one, nothing to upload
+	}
+
+	if update.Message.Photo == nil || len(* update.Message.Photo) == 0 {
+		bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "⚠️ there's no photo in this message, please send one"))
+		return
+	}
+
 	photos := * update.Message.Photo
 	lastPhoto := photos[len(photos) -1] // get the biggest possible photo size
+
+	if reason, tooSmall := photoTooSmall(lastPhoto); tooSmall {
+		bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "⚠️ skipped the photo: " + reason))
+		return
+	}
 	photoId := lastPhoto.FileID
 
 	photo, err := bot.GetFile(tgbotapi.FileConfig{FileID: photoId})
@@ -304,7 +1038,11 @@ func handleUpdate(bot * tgbotapi.BotAPI, update tgbotapi.Update) {
 	}
 
 	photoUrl := "https://api.telegram.org/file/bot" + bot.Token + "/" + photo.FilePath
-	uploadPhotoResponse := getFileAndUpload(photoUrl, bot, update)
+	uploadPhotoResponse, uploaded := getFileAndUpload(photoUrl, bot, update)
+
+	if !uploaded {
+		return
+	}
 
 	responseMessage := fmt.Sprintf("✅ Upload status: %s", uploadPhotoResponse.Status)
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, responseMessage)
@@ -312,6 +1050,19 @@ func handleUpdate(bot * tgbotapi.BotAPI, update tgbotapi.Update) {
 	bot.Send(msg)
 }
 
+// photoTooSmall checks the photo against MIN_PHOTO_WIDTH and MIN_PHOTO_HEIGHT,
+// tiny images like thumbnails get useless captions and hashtags
+func photoTooSmall(photo tgbotapi.PhotoSize) (string, bool) {
+	minWidth := getEnvNonNegativeInt("MIN_PHOTO_WIDTH", 0)
+	minHeight := getEnvNonNegativeInt("MIN_PHOTO_HEIGHT", 0)
+
+	if photo.Width < minWidth || photo.Height < minHeight {
+		return fmt.Sprintf("it's %dx%d, at least %dx%d is needed", photo.Width, photo.Height, minWidth, minHeight), true
+	}
+
+	return "", false
+}
+
 func disableComments(insta *goinsta.Instagram, uploadPhotoResponse response.UploadPhotoResponse) {
 	_, err := insta.DisableComments(uploadPhotoResponse.Media.ID)
 
@@ -322,12 +1073,21 @@ func disableComments(insta *goinsta.Instagram, uploadPhotoResponse response.Uplo
 
 func getHashtags(resp * http.Response) string {
 	ctx := context.Background()
+
+	if timeout := getEnvTimeout("VISION_API_TIMEOUT"); timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	client, err := vision.NewImageAnnotatorClient(ctx)
 
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't start Google Vision Image Annotator Client: %s", err))
 	}
 
+	defer client.Close()
+
 	b := bytes.NewBuffer(make([]byte, 0)) // temporary buffer
 	photo := io.TeeReader(resp.Body, b) // returns a reader that writes contents of resp.Body to b
 
@@ -346,7 +1106,7 @@ func getHashtags(resp * http.Response) string {
 		panic(fmt.Sprintf("Couldn't detect image labels: %s", err))
 	}
 
-	defer ctx.Done()
+	audit("labels received from Google Vision: %d labels", len(labels))
 
 	res := ""
 
@@ -367,22 +1127,227 @@ func getPhoto(uri string) * http.Response {
 
 	parsed, err := url.Parse(uri)
 
-	if parsed.Host == "" || err != nil {
+	if err != nil || parsed.Host == "" {
 		panic(fmt.Sprintf("Incorrect photo url provided: %s", uri))
 	}
 
-	resp, err := http.Get(uri)
+	requireHttps("photo", uri)
+
+	// image hosts sometimes fail transiently, so server errors are retried with a growing delay
+	retries := getEnvNonNegativeInt("PHOTO_FETCH_RETRIES", 2)
+	backoff := time.Duration(getEnvInt("PHOTO_FETCH_BACKOFF", 500)) * time.Millisecond
+
+	timeout := getEnvTimeout("PHOTO_FETCH_TIMEOUT") // for each of the attempts
+	budget := getEnvTimeout("PHOTO_FETCH_BUDGET") // for all the attempts and waits together
+	deadline := time.Now().Add(budget)
+	ctx := context.Background()
+
+	if budget != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel() // the body is read in full before returning
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	fetch := func() (* http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Do(req)
+	}
+
+	resp, err := fetch()
+
+	for attempt := 0; err == nil && resp.StatusCode >= 500 && attempt < retries; attempt++ {
+		wait := backoff << uint(attempt)
+
+		// no point in waiting for an attempt that won't fit in the budget
+		if budget != 0 && time.Now().Add(wait + timeout).After(deadline) {
+			break
+		}
+
+		resp.Body.Close()
+		time.Sleep(wait)
+		resp, err = fetch()
+	}
 
 	if err != nil {
-		panic(fmt.Sprintf("Could not get the photo by %s", uri))
+		if urlErr, isUrlErr := err.(* url.Error); isUrlErr {
+			err = urlErr.Err // it quotes the full url
+		}
+
+		panic(fmt.Sprintf("Could not get the photo from %s: %s", parsed.Host, err))
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		panic(fmt.Sprintf("Could not get the photo from %s: %s", parsed.Host, resp.Status))
+	}
+
+	maxSize := maxPhotoSize()
+
+	// reject obviously too big photos before reading the body
+	if resp.ContentLength > maxSize {
+		resp.Body.Close()
+		panic(fmt.Sprintf("Photo from %s is too big: %d bytes, max is %d", parsed.Host, resp.ContentLength, maxSize))
+	}
+
+	// Content-Length could be missing or wrong, so never read more than allowed
+	photo, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize + 1))
+	resp.Body.Close()
+
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't read the photo from %s: %s", parsed.Host, err))
+	}
+
+	if int64(len(photo)) > maxSize {
+		panic(fmt.Sprintf("Photo from %s is too big, max is %d bytes", parsed.Host, maxSize))
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(photo))
+
+	audit("photo fetched from %s: %d bytes", parsed.Host, len(photo)) // the full url would leak the bot token
+
 	return resp
 }
 
+var (
+	auditLog * log.Logger
+	auditLogOnce sync.Once
+)
+
+// audit records an interaction with an external API in AUDIT_LOG_FILE, apart from the
+// operational output, nothing is recorded if the file isn't set
+func audit(format string, v ...interface{}) {
+	auditLogOnce.Do(func() {
+		auditLog = log.New(ioutil.Discard, "", 0)
+		auditFile := os.Getenv("AUDIT_LOG_FILE")
+
+		if len(auditFile) == 0 {
+			return
+		}
+
+		file, err := os.OpenFile(auditFile, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't open audit log file '%s': %s", auditFile, err))
+		}
+
+		auditLog = log.New(file, "", log.LstdFlags | log.Lmicroseconds | log.LUTC)
+	})
+
+	auditLog.Printf(format, v...)
+}
+
+// secretProvider looks secrets up by name, it could be backed by a cloud secrets manager
+type secretProvider interface {
+	getSecret(name string) (string, error)
+}
+
+// envSecretProvider reads the secret from the name environment variable or, if it's
+// not set, from the file in name + "_FILE" as Docker and K8s secrets do
+type envSecretProvider struct{}
+
+func (envSecretProvider) getSecret(name string) (string, error) {
+	if secret := os.Getenv(name); len(secret) != 0 {
+		return secret, nil
+	}
+
+	secretFile := os.Getenv(name + "_FILE")
+
+	if len(secretFile) == 0 {
+		return "", nil
+	}
+
+	secret, err := ioutil.ReadFile(secretFile)
+
+	if err != nil {
+		return "", fmt.Errorf("couldn't read file '%s': %s", secretFile, err)
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+var secrets secretProvider = envSecretProvider{}
+
+func getSecret(name string) string {
+	secret, err := secrets.getSecret(name)
+
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't get secret %s: %s", name, err))
+	}
+
+	return secret
+}
+
+// requireHttps refuses plain http urls unless ALLOW_INSECURE is set
+func requireHttps(name string, uri string) {
+	if len(os.Getenv("ALLOW_INSECURE")) != 0 {
+		return
+	}
+
+	parsed, err := url.Parse(uri)
+
+	if err != nil || parsed.Scheme != "https" {
+		panic(fmt.Sprintf("Refusing to use insecure %s url '%s', set ALLOW_INSECURE to override", name, uri))
+	}
+}
+
+func maxPhotoSize() int64 {
+	// Telegram won't let bots download anything bigger anyway
+	return int64(getEnvInt("MAX_PHOTO_SIZE", 20 * 1024 * 1024))
+}
+
+func getEnv(name string, defaultValue string) string {
+	if value := os.Getenv(name); len(value) != 0 {
+		return value
+	}
+
+	return defaultValue
+}
+
+// getEnvTimeout reads a timeout in seconds from the name environment variable, no timeout if it's not set or 0
+func getEnvTimeout(name string) time.Duration {
+	return time.Duration(getEnvNonNegativeInt(name, 0)) * time.Second
+}
+
+// getEnvInt reads a positive number from the name environment variable,
+// falling back to defaultValue if it's not set
+func getEnvInt(name string, defaultValue int) int {
+	number := getEnvNonNegativeInt(name, defaultValue)
+
+	if number == 0 && len(os.Getenv(name)) != 0 {
+		panic(fmt.Sprintf("Please provide a valid positive number for %s, got '%s'", name, os.Getenv(name)))
+	}
+
+	return number
+}
+
+// getEnvNonNegativeInt is getEnvInt for settings where 0 makes sense,
+// such as a retry count or a limit that 0 switches off
+func getEnvNonNegativeInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+
+	if len(value) == 0 {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 0 {
+		panic(fmt.Sprintf("Please provide a valid non-negative number for %s, got '%s'", name, value))
+	}
+
+	return number
+}
+
 func loginInstagram() * goinsta.Instagram {
 	username := os.Getenv("INSTAGRAM_USERNAME")
-	password := os.Getenv("INSTAGRAM_PASSWORD")
+	password := getSecret("INSTAGRAM_PASSWORD")
 
 	if len(username) * len(password) == 0 {
 		panic("No Instagram username and/or password provided.")
@@ -409,5 +1374,7 @@ func upload(insta * goinsta.Instagram, photo io.ReadCloser, caption string) resp
 		panic(fmt.Sprintf("Couldn't upload photo to instagram: %s", err))
 	}
 
+	audit("photo uploaded to Instagram: status %s, media id %s, %d characters caption", uploadPhotoResponse.Status, uploadPhotoResponse.Media.ID, utf8.RuneCountInString(caption))
+
 	return uploadPhotoResponse
 }
\ No newline at end of file
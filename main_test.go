@@ -0,0 +1,1078 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// setEnv sets an environment variable for the test, the returned func puts the previous value back
+func setEnv(name string, value string) func() {
+	previous, wasSet := os.LookupEnv(name)
+	os.Setenv(name, value)
+
+	return func() {
+		if wasSet {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// expectPanic returns what f panicked with, the test fails if it didn't panic
+func expectPanic(t * testing.T, name string, f func()) (message string) {
+	t.Helper()
+
+	defer func() {
+		if r := recover(); r != nil {
+			message = fmt.Sprint(r)
+		} else {
+			t.Errorf("%s: expected a panic", name)
+		}
+	}()
+
+	f()
+
+	return ""
+}
+
+func body(res * http.Response) string {
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	return string(body)
+}
+
+func responseWith(body string) * http.Response {
+	return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func TestGetPhotoSizeLimit(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("MAX_PHOTO_SIZE", "5")()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		switch r.URL.Path {
+		case "/file/bot123:secret/big.jpg":
+			w.Header().Set("Content-Length", "1073741824")
+			w.(http.Flusher).Flush()
+		case "/file/bot123:secret/chunked.jpg":
+			fmt.Fprint(w, "bigger")
+			w.(http.Flusher).Flush() // no Content-Length this way
+			fmt.Fprint(w, " photo")
+		default:
+			fmt.Fprint(w, "photo")
+		}
+	}))
+	defer server.Close()
+
+	if got := body(getPhoto(server.URL + "/file/bot123:secret/photo.jpg")); got != "photo" {
+		t.Errorf("photo at the limit: got '%s'", got)
+	}
+
+	message := expectPanic(t, "Content-Length over the limit", func() { getPhoto(server.URL + "/file/bot123:secret/big.jpg") })
+
+	if !strings.Contains(message, "1073741824 bytes, max is 5") {
+		t.Errorf("Content-Length over the limit: not rejected by the header, got '%s'", message)
+	}
+
+	message = expectPanic(t, "body over the limit", func() { getPhoto(server.URL + "/file/bot123:secret/chunked.jpg") })
+
+	if strings.Contains(message, "secret") {
+		t.Errorf("the bot token leaked into '%s'", message)
+	}
+}
+
+func TestRequireHttps(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "")()
+
+	requireHttps("caption api", "https://caption.example.com")
+	expectPanic(t, "http caption url", func() { requireHttps("caption api", "http://caption.example.com") })
+	expectPanic(t, "no scheme", func() { requireHttps("caption api", "caption.example.com") })
+
+	defer setEnv("CAPTION_API_URL", "http://caption.example.com")()
+	defer setEnv("CAPTION_API_KEY", "key")()
+	photo := responseWith("photo")
+	message := expectPanic(t, "http caption url in getCaption", func() { getCaption(photo) })
+
+	if !strings.Contains(message, "insecure caption api url") {
+		t.Errorf("http caption url in getCaption: got '%s'", message)
+	}
+
+	os.Setenv("ALLOW_INSECURE", "1")
+	requireHttps("caption api", "http://caption.example.com")
+}
+
+func TestGetCaptionAuthFailure(t * testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, "<html>no entry</html>") // not json, so a parse error would show up
+		}))
+
+		restore := []func(){setEnv("ALLOW_INSECURE", "1"), setEnv("CAPTION_API_URL", server.URL), setEnv("CAPTION_API_KEY", "expired")}
+
+		photo := responseWith("photo")
+		message := expectPanic(t, http.StatusText(status), func() { getCaption(photo) })
+
+		if !strings.Contains(message, "CAPTION_API_KEY") || !strings.Contains(message, fmt.Sprint(status)) {
+			t.Errorf("%d: the panic doesn't point at the key, got '%s'", status, message)
+		}
+
+		for _, r := range restore {
+			r()
+		}
+
+		server.Close()
+	}
+}
+
+func TestNormalizeCaption(t * testing.T) {
+	raw := "  a  dog\non grass . \n"
+
+	if got := normalizeCaption(raw); got != "a dog on grass ." {
+		t.Errorf("whitespace only: got '%s'", got)
+	}
+
+	defer setEnv("CAPTION_STRIP_PERIOD", "1")()
+
+	if got := normalizeCaption(raw); got != "a dog on grass" {
+		t.Errorf("strip period: got '%s'", got)
+	}
+
+	if got := normalizeCaption("a dog on grass."); got != "a dog on grass" {
+		t.Errorf("strip period: got '%s'", got)
+	}
+
+	defer setEnv("CAPTION_SENTENCE_CASE", "1")()
+
+	if got := normalizeCaption(raw); got != "A dog on grass" {
+		t.Errorf("sentence case: got '%s'", got)
+	}
+
+	if got := normalizeCaption("élan"); got != "Élan" {
+		t.Errorf("sentence case of a non-ascii letter: got '%s'", got)
+	}
+
+	if got := normalizeCaption(" . "); got != "" {
+		t.Errorf("nothing left: got '%s'", got)
+	}
+}
+
+func TestEnvSecretProvider(t * testing.T) {
+	dir, err := ioutil.TempDir("", "instabot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	ioutil.WriteFile(secretFile, []byte("from file\n"), 0600)
+
+	provider := envSecretProvider{}
+	defer setEnv("TEST_SECRET", "")()
+	defer setEnv("TEST_SECRET_FILE", "")()
+
+	if secret, err := provider.getSecret("TEST_SECRET"); secret != "" || err != nil {
+		t.Errorf("nothing set: got '%s', %v", secret, err)
+	}
+
+	os.Setenv("TEST_SECRET_FILE", secretFile)
+
+	if secret, err := provider.getSecret("TEST_SECRET"); secret != "from file" || err != nil {
+		t.Errorf("file: got '%s', %v", secret, err)
+	}
+
+	os.Setenv("TEST_SECRET", "from env")
+
+	if secret, err := provider.getSecret("TEST_SECRET"); secret != "from env" || err != nil {
+		t.Errorf("env over file: got '%s', %v", secret, err)
+	}
+
+	os.Setenv("TEST_SECRET", "")
+	os.Setenv("TEST_SECRET_FILE", filepath.Join(dir, "missing"))
+
+	if _, err := provider.getSecret("TEST_SECRET"); err == nil {
+		t.Errorf("missing file: expected an error")
+	}
+}
+
+func TestTruncateCaption(t * testing.T) {
+	tests := []struct {
+		caption string
+		maxLength int
+		ellipsis bool
+		want string
+	}{
+		{"a dog on the grass", 18, false, "a dog on the grass"},
+		{"a dog on the grass", 10, false, "a dog on"},
+		{"a dog on the grass", 8, false, "a dog on"},
+		{"a dog on the grass", 10, true, "a dog on…"},
+		{"a dog    on the grass", 10, false, "a dog"},
+		{"supercalifragilistic", 5, false, "super"},
+		{"supercalifragilistic", 5, true, "supe…"},
+		{"привет мир", 8, false, "привет"},
+	}
+
+	for _, test := range tests {
+		ellipsis := ""
+
+		if test.ellipsis {
+			ellipsis = "1"
+		}
+
+		restore := setEnv("CAPTION_ELLIPSIS", ellipsis)
+
+		if got := truncateCaption(test.caption, test.maxLength); got != test.want {
+			t.Errorf("truncateCaption('%s', %d) with ellipsis %v = '%s', want '%s'", test.caption, test.maxLength, test.ellipsis, got, test.want)
+		}
+
+		restore()
+	}
+}
+
+func TestCaptionClientReusesConnections(t * testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		fmt.Fprint(w, `{"output": "a dog"}`)
+	}))
+	defer server.Close()
+
+	client := getCaptionClient()
+
+	if client != getCaptionClient() {
+		t.Fatalf("every call got a new client")
+	}
+
+	var reused []bool
+
+	for i := 0; i < 2; i++ {
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) }}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		res, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i + 1, err)
+		}
+
+		body(res) // the connection goes back to the pool once the body is read and closed
+	}
+
+	if len(reused) != 2 || reused[0] || !reused[1] {
+		t.Errorf("got connections reused %v, want [false true]", reused)
+	}
+}
+
+func isPaused() bool {
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+
+	return paused
+}
+
+// waitForPause polls until the signal got to the watcher, signals are delivered asynchronously
+func waitForPause(t * testing.T, want bool) {
+	t.Helper()
+
+	for start := time.Now(); isPaused() != want; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5 * time.Second {
+			t.Fatalf("paused is still %t", !want)
+		}
+	}
+}
+
+var watchPauseOnce sync.Once // a second watcher would undo every toggle of the first
+
+func TestPauseSignal(t * testing.T) {
+	watchPauseOnce.Do(watchPauseSignal)
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	waitForPause(t, true)
+
+	resumed := make(chan struct{})
+
+	go func() {
+		waitWhilePaused()
+		close(resumed)
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatalf("waitWhilePaused returned while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waitWhilePaused didn't return after the second signal")
+	}
+
+	if isPaused() {
+		t.Errorf("still paused after the second signal")
+	}
+}
+
+func TestLookupJsonPath(t * testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{"Data": {"captions": [{"text": "a dog"}]}, "empty": null}`), &value)
+
+	tests := []struct {
+		path string
+		want interface{}
+		found bool
+	}{
+		{"data.captions.0.text", "a dog", true},
+		{"Data.Captions.0.Text", "a dog", true},
+		{"empty", nil, true},
+		{"data.captions.1.text", nil, false},
+		{"data.captions.-1", nil, false},
+		{"data.captions.first", nil, false},
+		{"data.captions.0.text.more", nil, false},
+		{"missing", nil, false},
+	}
+
+	for _, test := range tests {
+		got, found := lookupJsonPath(value, test.path)
+
+		if got != test.want || found != test.found {
+			t.Errorf("lookupJsonPath(%s) = %v, %v, want %v, %v", test.path, got, found, test.want, test.found)
+		}
+	}
+}
+
+func TestParseCaptionResponse(t * testing.T) {
+	caption, jobId := parseCaptionResponse(responseWith(`{"output": "a dog", "job_id": 12345678901234567890}`))
+
+	if caption != "a dog" || jobId != "12345678901234567890" {
+		t.Errorf("default paths: got '%s', '%s'", caption, jobId)
+	}
+
+	defer setEnv("CAPTION_API_OUTPUT_PATH", "result.text")()
+	defer setEnv("CAPTION_API_JOB_ID_PATH", "meta.id")()
+	defer setEnv("CAPTION_API_ERROR_PATH", "error")()
+
+	caption, jobId = parseCaptionResponse(responseWith(`{"result": {"text": "a cat"}, "meta": {"id": "abc"}, "error": null}`))
+
+	if caption != "a cat" || jobId != "abc" {
+		t.Errorf("configured paths: got '%s', '%s'", caption, jobId)
+	}
+
+	caption, jobId = parseCaptionResponse(responseWith(`{"result": {"text": "a cat"}}`))
+
+	if caption != "a cat" || jobId != "" {
+		t.Errorf("missing job id: got '%s', '%s'", caption, jobId)
+	}
+
+	caption, jobId = parseCaptionResponse(responseWith(`{"result": {"text": "a cat"}, "meta": {"id": null}}`))
+
+	if caption != "a cat" || jobId != "" {
+		t.Errorf("null job id: got '%s', '%s'", caption, jobId)
+	}
+
+	expectPanic(t, "api error", func() { parseCaptionResponse(responseWith(`{"error": "quota exceeded"}`)) })
+	expectPanic(t, "missing caption", func() { parseCaptionResponse(responseWith(`{"result": {}}`)) })
+	expectPanic(t, "caption not a string", func() { parseCaptionResponse(responseWith(`{"result": {"text": 1}}`)) })
+	expectPanic(t, "broken json", func() { parseCaptionResponse(responseWith(`{`)) })
+}
+
+type fakeSecretProvider map[string]string
+
+func (f fakeSecretProvider) getSecret(name string) (string, error) {
+	if secret, found := f[name]; found {
+		return secret, nil
+	}
+
+	return "", fmt.Errorf("no secret %s in the fake", name)
+}
+
+func TestGetSecretFromProvider(t * testing.T) {
+	defer func(previous secretProvider) { secrets = previous }(secrets)
+	defer setEnv("CAPTION_API_KEY", "from env")()
+	secrets = fakeSecretProvider{"CAPTION_API_KEY": "from the manager"}
+
+	if got := getSecret("CAPTION_API_KEY"); got != "from the manager" {
+		t.Errorf("got '%s', want the provider's key", got)
+	}
+
+	message := expectPanic(t, "provider error", func() { getSecret("INSTAGRAM_PASSWORD") })
+
+	if !strings.Contains(message, "no secret INSTAGRAM_PASSWORD in the fake") {
+		t.Errorf("provider error: got '%s'", message)
+	}
+}
+
+func TestReadCaptionStream(t * testing.T) {
+	raw := ": comment\nevent: token\ndata: a\n\ndata:  dog\n\ndata: [DONE]\n\ndata: ignored\n"
+
+	if got := readCaptionStream(responseWith(raw)); got != "a dog" {
+		t.Errorf("raw tokens: got '%s', want 'a dog'", got)
+	}
+
+	defer setEnv("CAPTION_API_STREAM_TOKEN_PATH", "choices.0.delta.content")()
+	events := "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\" dog\"}}]}\n\n"
+
+	if got := readCaptionStream(responseWith(events)); got != "a dog" {
+		t.Errorf("json events: got '%s', want 'a dog'", got)
+	}
+
+	expectPanic(t, "broken json event", func() { readCaptionStream(responseWith("data: {\n")) })
+}
+
+func TestReadCaptionStreamTimeout(t * testing.T) {
+	defer setEnv("CAPTION_API_STREAM_TIMEOUT", "1")()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	expectPanic(t, "stalled stream", func() { readCaptionStream(&http.Response{Body: reader}) })
+
+	defer setEnv("CAPTION_API_STREAM_TIMEOUT", "0")()
+
+	if got := readCaptionStream(responseWith("data: a dog\n")); got != "a dog" {
+		t.Errorf("no timeout: got '%s', want 'a dog'", got)
+	}
+}
+
+func TestGetCaptionStream(t * testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		for _, token := range []string{"a", " dog", " on", " grass"} {
+			fmt.Fprintf(w, "data: %s\n\n", token)
+			w.(http.Flusher).Flush()
+		}
+
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("CAPTION_API_URL", server.URL)()
+	defer setEnv("CAPTION_API_KEY", "key")()
+
+	if caption, jobId := getCaption(responseWith("photo")); caption != "a dog on grass" || jobId != "" {
+		t.Errorf("got '%s', '%s', want the assembled caption", caption, jobId)
+	}
+}
+
+func TestAddExtraFields(t * testing.T) {
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	addExtraFields(w, "model=large&lang=en&model=small&note=a+dog")
+	w.Close()
+
+	var got []string
+	r := multipart.NewReader(&form, w.Boundary())
+
+	for {
+		part, err := r.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("couldn't read form data: %s", err)
+		}
+
+		value, _ := ioutil.ReadAll(part)
+		got = append(got, part.FormName() + "=" + string(value))
+	}
+
+	want := "lang=en model=large model=small note=a dog"
+
+	if strings.Join(got, " ") != want {
+		t.Errorf("got fields %q, want %s", got, want)
+	}
+
+	expectPanic(t, "broken fields", func() { addExtraFields(multipart.NewWriter(ioutil.Discard), "model=%zz") })
+}
+
+func TestGetCaptionSendsExtraFields(t * testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		if model := r.FormValue("model"); model != "large" {
+			t.Errorf("got model field '%s', want 'large'", model)
+		}
+
+		if _, _, err := r.FormFile("image"); err != nil {
+			t.Errorf("no photo next to the extra fields: %s", err)
+		}
+
+		fmt.Fprint(w, `{"output": "a dog"}`)
+	}))
+	defer server.Close()
+
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("CAPTION_API_URL", server.URL)()
+	defer setEnv("CAPTION_API_KEY", "key")()
+	defer setEnv("CAPTION_API_EXTRA_FIELDS", "model=large")()
+
+	getCaption(responseWith("photo"))
+}
+
+// photoServer fails with 503 the given number of times before serving the photo
+func photoServer(failures int32, photo string, requests * int32) * httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprint(w, photo)
+	}))
+}
+
+func TestGetPhotoBudget(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("PHOTO_FETCH_BACKOFF", "2000")()
+	defer setEnv("PHOTO_FETCH_BUDGET", "1")()
+
+	var requests int32
+	server := photoServer(3, "photo", &requests)
+	defer server.Close()
+
+	expectPanic(t, "over the budget", func() { getPhoto(server.URL) })
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("got %d requests, the retry wouldn't fit in the budget", got)
+	}
+}
+
+func TestGetPhotoBudgetBoundary(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("PHOTO_FETCH_RETRIES", "5")()
+	defer setEnv("PHOTO_FETCH_BACKOFF", "200")()
+	defer setEnv("PHOTO_FETCH_BUDGET", "1")()
+
+	var requests int32
+	server := photoServer(5, "photo", &requests)
+	defer server.Close()
+
+	start := time.Now()
+	expectPanic(t, "budget used up", func() { getPhoto(server.URL) })
+
+	// waits of 200ms and 400ms fit in the second, the next 800ms one doesn't
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, over the budget", elapsed)
+	}
+}
+
+func TestPhotoTooSmall(t * testing.T) {
+	pixel := tgbotapi.PhotoSize{FileID: "pixel", Width: 1, Height: 1}
+
+	if _, tooSmall := photoTooSmall(pixel); tooSmall {
+		t.Errorf("no minimum set, still rejected")
+	}
+
+	defer setEnv("MIN_PHOTO_WIDTH", "320")()
+	defer setEnv("MIN_PHOTO_HEIGHT", "240")()
+
+	if reason, tooSmall := photoTooSmall(pixel); !tooSmall || reason != "it's 1x1, at least 320x240 is needed" {
+		t.Errorf("1x1: got '%s', %t", reason, tooSmall)
+	}
+
+	if _, tooSmall := photoTooSmall(tgbotapi.PhotoSize{Width: 320, Height: 100}); !tooSmall {
+		t.Errorf("too low but wide enough: not rejected")
+	}
+
+	if _, tooSmall := photoTooSmall(tgbotapi.PhotoSize{Width: 320, Height: 240}); tooSmall {
+		t.Errorf("exactly the minimum: rejected")
+	}
+}
+
+func TestDoHedged(t * testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		sent, _ := ioutil.ReadAll(r.Body)
+
+		if string(sent) != "photo" {
+			t.Errorf("attempt got body '%s', want 'photo'", sent)
+		}
+
+		if atomic.AddInt32(&requests, 1) == 1 { // the first attempt hangs until it's cancelled
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+
+			return
+		}
+
+		fmt.Fprint(w, "hedged")
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("photo")))
+	res, err := doHedged(server.Client(), req, 50 * time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("doHedged failed: %s", err)
+	}
+
+	if got := body(res); got != "hedged" {
+		t.Errorf("got '%s', want the hedged response", got)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+}
+
+func TestDoHedgedWithoutDelay(t * testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "only")
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("photo")))
+	res, err := doHedged(server.Client(), req, 0)
+
+	if err != nil {
+		t.Fatalf("doHedged failed: %s", err)
+	}
+
+	if got := body(res); got != "only" {
+		t.Errorf("got '%s', want 'only'", got)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestLimitCaption(t * testing.T) {
+	long := "a dog on the grass"
+
+	if got, err := limitCaption(long); got != long || err != nil {
+		t.Errorf("no limit: got '%s', %v", got, err)
+	}
+
+	defer setEnv("CAPTION_API_MAX_LENGTH", "10")()
+
+	if got, err := limitCaption("a dog"); got != "a dog" || err != nil {
+		t.Errorf("short caption: got '%s', %v", got, err)
+	}
+
+	if got, err := limitCaption(long); got != "a dog on" || err != nil {
+		t.Errorf("truncate by default: got '%s', %v", got, err)
+	}
+
+	restore := setEnv("CAPTION_API_OVERSIZE", "reject")
+
+	if _, err := limitCaption(long); err == nil {
+		t.Errorf("reject: expected an error")
+	}
+
+	restore()
+	defer setEnv("CAPTION_API_OVERSIZE", "drop")()
+
+	expectPanic(t, "unknown policy", func() { limitCaption(long) })
+}
+
+func TestGetPhotoRetries(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("PHOTO_FETCH_BACKOFF", "1")()
+
+	var requests int32
+	server := photoServer(2, "photo", &requests)
+	defer server.Close()
+
+	if got := body(getPhoto(server.URL)); got != "photo" || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("two failures: got '%s' after %d requests", got, atomic.LoadInt32(&requests))
+	}
+
+	var unretried int32
+	flaky := photoServer(1, "photo", &unretried)
+	defer flaky.Close()
+	defer setEnv("PHOTO_FETCH_RETRIES", "0")()
+
+	expectPanic(t, "no retries", func() { getPhoto(flaky.URL) })
+
+	if got := atomic.LoadInt32(&unretried); got != 1 {
+		t.Errorf("no retries: got %d requests", got)
+	}
+}
+
+func TestGetPhotoClientErrorsNotRetried(t * testing.T) {
+	defer setEnv("ALLOW_INSECURE", "1")()
+	defer setEnv("PHOTO_FETCH_BACKOFF", "1")()
+
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	expectPanic(t, "not found", func() { getPhoto(server.URL) })
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("got %d requests, a 404 shouldn't be retried", got)
+	}
+}
+
+func TestAuditPhotoFetched(t * testing.T) {
+	dir, err := ioutil.TempDir("", "instabot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// the audit log is opened once, so start over with it and leave a fresh one behind
+	resetAudit := func() {
+		auditLogOnce = sync.Once{}
+		auditLog = nil
+	}
+
+	resetAudit()
+	defer resetAudit()
+
+	auditFile := filepath.Join(dir, "audit.log")
+	defer setEnv("AUDIT_LOG_FILE", auditFile)()
+	defer setEnv("ALLOW_INSECURE", "1")()
+
+	var requests int32
+	server := photoServer(0, "photo", &requests)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		body(getPhoto(server.URL + "/file/bot123:secret/photo.jpg"))
+	}
+
+	logged, _ := ioutil.ReadFile(auditFile)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	if got := strings.Count(string(logged), "photo fetched from " + host + ": 5 bytes"); got != 2 {
+		t.Errorf("got %d photo entries for 2 photos in:\n%s", got, logged)
+	}
+
+	if strings.Contains(string(logged), "secret") {
+		t.Errorf("the bot token leaked into the audit log:\n%s", logged)
+	}
+}
+
+func TestPinCertificate(t * testing.T) {
+	cert := []byte("server certificate")
+	sum := sha256.Sum256(cert)
+	hexSum := fmt.Sprintf("%X", sum[:])
+
+	var pairs []string
+
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i + 2])
+	}
+
+	verify := pinCertificate(strings.Join(pairs, ":")) // the way openssl prints fingerprints
+
+	if err := verify([][]byte{cert, []byte("intermediate")}, nil); err != nil {
+		t.Errorf("pinned certificate refused: %s", err)
+	}
+
+	if err := verify([][]byte{[]byte("other certificate")}, nil); err == nil {
+		t.Errorf("other certificate let through")
+	}
+
+	if err := verify(nil, nil); err == nil {
+		t.Errorf("no certificate let through")
+	}
+
+	expectPanic(t, "not hex", func() { pinCertificate("not a fingerprint") })
+	expectPanic(t, "too short", func() { pinCertificate(hexSum[:32]) })
+}
+
+func TestPinnedConnection(t * testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		fmt.Fprint(w, "pinned")
+	}))
+	defer server.Close()
+
+	pinned := sha256.Sum256(server.Certificate().Raw)
+
+	get := func(fingerprint string) (* http.Response, error) {
+		transport := server.Client().Transport.(* http.Transport).Clone() // trusts the test certificate
+		transport.TLSClientConfig.VerifyPeerCertificate = pinCertificate(fingerprint)
+
+		return (&http.Client{Transport: transport}).Get(server.URL)
+	}
+
+	res, err := get(hex.EncodeToString(pinned[:]))
+
+	if err != nil {
+		t.Fatalf("pinned certificate refused: %s", err)
+	}
+
+	body(res)
+	other := sha256.Sum256([]byte("other certificate"))
+
+	if _, err := get(hex.EncodeToString(other[:])); err == nil || !strings.Contains(err.Error(), "doesn't match the pinned one") {
+		t.Errorf("mismatched certificate: got %v, want the connection refused", err)
+	}
+}
+
+func TestKeepFailedPhoto(t * testing.T) {
+	dir, err := ioutil.TempDir("", "instabot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	kept := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "failed-*.jpg"))
+		return names
+	}
+
+	keepFailedPhoto([]byte("photo")) // not enabled
+
+	if names := kept(); len(names) != 0 {
+		t.Fatalf("kept %v without FAILED_PHOTO_DIR", names)
+	}
+
+	defer setEnv("FAILED_PHOTO_DIR", dir)()
+	defer setEnv("FAILED_PHOTO_RETENTION", "1")()
+	defer setEnv("FAILED_PHOTO_DIR_MAX_SIZE", "10")()
+
+	stale := filepath.Join(dir, "failed-1.jpg")
+	ioutil.WriteFile(stale, []byte("old"), 0600)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale, old, old)
+
+	keepFailedPhoto([]byte("photo"))
+	names := kept()
+
+	if len(names) != 1 || names[0] == stale {
+		t.Fatalf("got %v, want only the new photo", names)
+	}
+
+	if photo, _ := ioutil.ReadFile(names[0]); string(photo) != "photo" {
+		t.Errorf("kept '%s', want the photo bytes", photo)
+	}
+
+	keepFailedPhoto([]byte("another photo")) // 5 + 13 bytes is over the cap
+
+	if names := kept(); len(names) != 1 {
+		t.Errorf("got %v, nothing should be written over the size cap", names)
+	}
+}
+
+func TestWaitForUploadSlot(t * testing.T) {
+	defer func(previous time.Time) { lastUpload = previous }(lastUpload)
+	lastUpload = time.Time{}
+
+	defer setEnv("MAX_UPLOADS_PER_MINUTE", "600")() // one every 100ms
+
+	start := time.Now()
+	waitForUploadSlot()
+
+	if elapsed := time.Since(start); elapsed > 50 * time.Millisecond {
+		t.Errorf("the first upload waited %s", elapsed)
+	}
+
+	waitForUploadSlot()
+
+	if elapsed := time.Since(start); elapsed < 90 * time.Millisecond {
+		t.Errorf("the second upload came %s after the first, the limit is one per 100ms", elapsed)
+	}
+}
+
+func TestFilterCaption(t * testing.T) {
+	if got := filterCaption("a dog"); got != "a dog" {
+		t.Errorf("no command: got '%s'", got)
+	}
+
+	defer setEnv("CAPTION_FILTER_COMMAND", "tr a-z A-Z")()
+	defer setEnv("ALLOW_CAPTION_FILTER_COMMAND", "")()
+
+	expectPanic(t, "not allowed", func() { filterCaption("a dog") })
+
+	os.Setenv("ALLOW_CAPTION_FILTER_COMMAND", "1")
+
+	if got := filterCaption("a dog"); got != "A DOG" {
+		t.Errorf("tr: got '%s', want 'A DOG'", got)
+	}
+
+	os.Setenv("CAPTION_FILTER_COMMAND", "echo a cat") // prints a trailing newline
+
+	if got := filterCaption("a dog"); got != "a cat" {
+		t.Errorf("echo: got '%s', want 'a cat'", got)
+	}
+
+	os.Setenv("CAPTION_FILTER_COMMAND", "ls /nonexistent-instabot-dir")
+	message := expectPanic(t, "failing command", func() { filterCaption("a dog") })
+
+	if !strings.Contains(message, "nonexistent-instabot-dir") || !strings.Contains(message, "exit status") {
+		t.Errorf("failing command: got '%s', want the exit status and stderr", message)
+	}
+
+	os.Setenv("CAPTION_FILTER_COMMAND", "sleep 5")
+	defer setEnv("CAPTION_FILTER_TIMEOUT", "1")()
+	start := time.Now()
+	expectPanic(t, "slow command", func() { filterCaption("a dog") })
+
+	if elapsed := time.Since(start); elapsed > 3 * time.Second {
+		t.Errorf("slow command ran for %s", elapsed)
+	}
+
+	os.Setenv("CAPTION_FILTER_COMMAND", "tr a-z A-Z")
+	os.Setenv("CAPTION_FILTER_TIMEOUT", "0")
+
+	if got := filterCaption("a dog"); got != "A DOG" {
+		t.Errorf("no timeout: got '%s', want 'A DOG'", got)
+	}
+}
+
+func TestServeConfig(t * testing.T) {
+	defer setEnv("DEBUG_CONFIG_TOKEN", "s3cr3t")()
+	defer setEnv("TELEGRAM_BOT_TOKEN", "123:abc")()
+	defer setEnv("CAPTION_API_EXTRA_FIELDS", "model=large&key=abc&key=def")()
+	defer setEnv("CAPTION_API_URL", "https://caption.example.com")()
+	defer setEnv("INSTAGRAM_PASSWORD", "")()
+	defer setEnv("MAX_CAPTION_LENGTH", "")()
+	defer setEnv("PHOTO_FETCH_RETRIES", "0")()
+
+	for _, authorization := range []string{"", "s3cr3t", "Bearer wrong", "bearer s3cr3t", "Bearer s3cr3t "} {
+		r := httptest.NewRequest("GET", "/debug/config", nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		serveConfig(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("authorization '%s': got status %d", authorization, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/debug/config", nil)
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	w := httptest.NewRecorder()
+	serveConfig(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	var config map[string]string
+
+	if err := json.NewDecoder(w.Body).Decode(&config); err != nil {
+		t.Fatalf("couldn't parse config: %s", err)
+	}
+
+	want := map[string]string{
+		"TELEGRAM_BOT_TOKEN": "<redacted>",
+		"DEBUG_CONFIG_TOKEN": "<redacted>",
+		"INSTAGRAM_PASSWORD": "",
+		"CAPTION_API_EXTRA_FIELDS": "key=<redacted>&key=<redacted>&model=<redacted>",
+		"CAPTION_API_URL": "https://caption.example.com",
+		"MAX_CAPTION_LENGTH": "2200",
+		"PHOTO_FETCH_RETRIES": "0",
+		"CAPTION_API_OVERSIZE": "truncate",
+	}
+
+	for name, value := range want {
+		if config[name] != value {
+			t.Errorf("%s: got '%s', want '%s'", name, config[name], value)
+		}
+	}
+
+	if len(config) != len(configNames) {
+		t.Errorf("got %d settings, want all %d", len(config), len(configNames))
+	}
+}
+
+func TestConfigDefaultsAreListed(t * testing.T) {
+	listed := make(map[string]bool)
+
+	for _, name := range configNames {
+		if listed[name] {
+			t.Errorf("%s is listed twice", name)
+		}
+
+		listed[name] = true
+	}
+
+	for name := range configDefaults {
+		if !listed[name] {
+			t.Errorf("%s has a default but isn't in configNames", name)
+		}
+	}
+}
+
+func TestWaitForMemory(t * testing.T) {
+	defer func(previous func(* runtime.MemStats)) { readMemStats = previous }(readMemStats)
+	defer setEnv("MAX_MEMORY_MB", "100")()
+
+	var used uint64 = 200 * 1024 * 1024
+	readMemStats = func(stats * runtime.MemStats) { stats.Sys = atomic.LoadUint64(&used) }
+
+	resumed := make(chan struct{})
+
+	go func() {
+		waitForMemory()
+		close(resumed)
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatalf("waitForMemory returned while over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	atomic.StoreUint64(&used, 50 * 1024 * 1024)
+
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waitForMemory didn't return once back under the limit")
+	}
+}
+
+func TestGetEmojiBadStatus(t * testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r * http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	defer setEnv("EMOJI_API_URL", server.URL)()
+	message := expectPanic(t, "500", func() { getEmoji("a dog") })
+
+	if !strings.Contains(message, "500 Internal Server Error") {
+		t.Errorf("got '%s', want the status", message)
+	}
+}